@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// DurableJob is the at-least-once counterpart to Job: every Enqueue persists
+// the payload to Postgres in the same call instead of buffering it in
+// memory, and a pool of workers leases rows with SELECT ... FOR UPDATE SKIP
+// LOCKED until they succeed, are retried with backoff, or are dead-lettered.
+// Pick Job when occasional loss on crash is acceptable and throughput
+// matters most; pick DurableJob when every accepted item must survive a
+// restart.
+type DurableJob struct {
+	DB *sqlx.DB
+
+	// Workers is the number of goroutines leasing and processing rows.
+	Workers int
+	// LeaseBatch is how many rows a single worker claims per poll.
+	LeaseBatch int
+	// PollInterval is how often an idle worker checks for work.
+	PollInterval time.Duration
+	// MaxAttempts is the number of failures after which a row is
+	// dead-lettered instead of retried.
+	MaxAttempts int
+	// LeaseTimeout bounds how long a row may stay locked before the reaper
+	// reclaims it, so a worker that dies or is killed mid-process doesn't
+	// lock the row forever.
+	LeaseTimeout time.Duration
+	// ProcessTimeout bounds how long process's DB writes are given once a
+	// row is leased. It's derived from context.Background rather than the
+	// worker's ctx so a row already being processed still gets a chance to
+	// commit (or fail cleanly) during graceful shutdown instead of having
+	// its writes fail against an already-cancelled context.
+	ProcessTimeout time.Duration
+
+	lockedBy string
+	finish   func()
+	done     chan struct{}
+}
+
+// NewDurableJob returns a DurableJob with the defaults this package ships
+// with; callers override Workers/LeaseBatch/MaxAttempts before calling Run.
+func NewDurableJob(db *sqlx.DB) *DurableJob {
+	return &DurableJob{
+		DB:             db,
+		Workers:        4,
+		LeaseBatch:     16,
+		PollInterval:   250 * time.Millisecond,
+		MaxAttempts:    5,
+		LeaseTimeout:   2 * time.Minute,
+		ProcessTimeout: 30 * time.Second,
+		lockedBy:       fmt.Sprintf("%d", os.Getpid()),
+		done:           make(chan struct{}),
+	}
+}
+
+func mustSetupDurableDB(db *sqlx.DB) {
+	sqlx.MustExec(db, `
+	CREATE TABLE IF NOT EXISTS jobs (
+		id bigserial primary key,
+		queue text not null default 'default',
+		priority smallint not null default 0,
+		run_at timestamptz not null default now(),
+		payload jsonb not null,
+		locked_at timestamptz,
+		locked_by text,
+		error_count int not null default 0,
+		last_error text
+	)`)
+	sqlx.MustExec(db, `
+	CREATE INDEX IF NOT EXISTS jobs_ready_idx ON jobs (queue, priority desc, run_at)
+	WHERE locked_at IS NULL`)
+}
+
+var errDeadLettered = errors.New("job dead-lettered: max attempts exceeded")
+
+// Enqueue inserts a single row via the job's own DB handle and is meant to
+// be called from the HTTP handler so the payload is durable before the
+// request returns. Use EnqueueTx when the insert needs to commit atomically
+// with other work in the same request.
+func (d *DurableJob) Enqueue(ctx context.Context, r *requestPayload) error {
+	return d.enqueue(ctx, d.DB, r)
+}
+
+// EnqueueTx inserts a single row via ext instead of d.DB, so a caller that
+// already has an in-flight *sqlx.Tx can commit the insert atomically with
+// other work in the same request.
+func (d *DurableJob) EnqueueTx(ctx context.Context, ext sqlx.ExtContext, r *requestPayload) error {
+	return d.enqueue(ctx, ext, r)
+}
+
+func (d *DurableJob) enqueue(ctx context.Context, ext sqlx.ExtContext, r *requestPayload) error {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = ext.ExecContext(ctx, `INSERT INTO jobs (payload) VALUES ($1)`, payload)
+	return err
+}
+
+// EnqueueBatch persists many rows in one round trip via COPY, for callers
+// that buffer requests before handing them off (e.g. a batched HTTP
+// endpoint or a migration from the in-memory Job).
+func (d *DurableJob) EnqueueBatch(ctx context.Context, rows []*requestPayload) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	tx, err := d.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("jobs", "payload"))
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		payload, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, payload); err != nil {
+			return err
+		}
+	}
+
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Run starts the worker pool and blocks until ctx is cancelled, at which
+// point it waits for in-flight leases to finish before returning.
+func (d *DurableJob) Run(ctx context.Context) {
+	log.Println("Started durable job workers", d.Workers)
+
+	d.reapExpiredLeases(ctx)
+
+	var wg sync.WaitGroup
+	wg.Add(d.Workers + 1)
+	for i := 0; i < d.Workers; i++ {
+		go func(n int) {
+			defer wg.Done()
+			d.worker(ctx, n)
+		}(i)
+	}
+	go func() {
+		defer wg.Done()
+		d.reapLoop(ctx)
+	}()
+
+	wg.Wait()
+	close(d.done)
+	log.Println("Exiting durable job workers")
+}
+
+// reapLoop periodically reclaims leases that have outlived LeaseTimeout,
+// covering a worker that died or was killed between committing a lease and
+// finishing process. It stops once ctx is cancelled, same as the workers.
+func (d *DurableJob) reapLoop(ctx context.Context) {
+	ticker := time.NewTicker(d.LeaseTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.reapExpiredLeases(ctx)
+		}
+	}
+}
+
+// reapExpiredLeases clears locked_at/locked_by on any row whose lease is
+// older than LeaseTimeout, making it eligible for lease again.
+func (d *DurableJob) reapExpiredLeases(ctx context.Context) {
+	res, err := d.DB.ExecContext(ctx, `
+		UPDATE jobs SET locked_at = NULL, locked_by = NULL
+		WHERE locked_at IS NOT NULL AND locked_at < now() - $1 * interval '1 second'`,
+		d.LeaseTimeout.Seconds())
+	if err != nil {
+		log.Println("[durable] failed to reap expired leases:", err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Println("[durable] reaped", n, "expired lease(s)")
+	}
+}
+
+// Done returns a channel that's closed once every worker has stopped.
+func (d *DurableJob) Done() <-chan struct{} {
+	return d.done
+}
+
+type leasedJob struct {
+	ID         int64           `db:"id"`
+	Payload    json.RawMessage `db:"payload"`
+	ErrorCount int             `db:"error_count"`
+}
+
+func (d *DurableJob) worker(ctx context.Context, n int) {
+	ticker := time.NewTicker(d.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		rows, err := d.lease(ctx)
+		if err != nil {
+			log.Println("[durable worker", n, "] lease error:", err.Error())
+			continue
+		}
+
+		for _, row := range rows {
+			d.process(ctx, row)
+		}
+	}
+}
+
+// lease claims up to LeaseBatch ready rows for this worker inside a single
+// transaction, using FOR UPDATE SKIP LOCKED so concurrent workers (in this
+// process or another) never contend on the same row.
+func (d *DurableJob) lease(ctx context.Context) ([]leasedJob, error) {
+	tx, err := d.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var rows []leasedJob
+	err = tx.SelectContext(ctx, &rows, `
+		SELECT id, payload, error_count FROM jobs
+		WHERE run_at <= now() AND locked_at IS NULL AND queue <> 'dead-letter'
+		ORDER BY priority DESC, run_at
+		FOR UPDATE SKIP LOCKED
+		LIMIT $1`, d.LeaseBatch)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]int64, len(rows))
+	for i, r := range rows {
+		ids[i] = r.ID
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE jobs SET locked_at = now(), locked_by = $1
+		WHERE id = ANY($2)`, d.lockedBy, pq.Array(ids)); err != nil {
+		return nil, err
+	}
+
+	return rows, tx.Commit()
+}
+
+// process writes against a context derived from context.Background rather
+// than the worker's ctx, so a row that's already leased still gets a chance
+// to finish (or get cleanly rescheduled via fail) when ctx is cancelled for
+// shutdown instead of having every write fail and leave the row locked until
+// the reaper reclaims it.
+func (d *DurableJob) process(ctx context.Context, row leasedJob) {
+	dbCtx, cancel := context.WithTimeout(context.Background(), d.ProcessTimeout)
+	defer cancel()
+
+	var payload requestPayload
+	if err := json.Unmarshal(row.Payload, &payload); err != nil {
+		d.fail(dbCtx, row, err)
+		return
+	}
+
+	if _, err := d.DB.ExecContext(dbCtx, `INSERT INTO records (name) VALUES ($1)`, payload.Name); err != nil {
+		d.fail(dbCtx, row, err)
+		return
+	}
+
+	if _, err := d.DB.ExecContext(dbCtx, `DELETE FROM jobs WHERE id = $1`, row.ID); err != nil {
+		log.Println("[durable] failed to delete completed job", row.ID, err.Error())
+	}
+}
+
+func (d *DurableJob) fail(ctx context.Context, row leasedJob, cause error) {
+	attempt := row.ErrorCount + 1
+	if attempt >= d.MaxAttempts {
+		log.Println("[durable] job", row.ID, "dead-lettered after", attempt, "attempts:", cause.Error())
+		if _, err := d.DB.ExecContext(ctx, `
+			UPDATE jobs SET error_count = $1, last_error = $2, locked_at = NULL, locked_by = NULL, queue = 'dead-letter'
+			WHERE id = $3`, attempt, errDeadLettered.Error()+": "+cause.Error(), row.ID); err != nil {
+			log.Println("[durable] failed to dead-letter job", row.ID, err.Error())
+		}
+		return
+	}
+
+	runAt := time.Now().Add(backoff(attempt))
+	if _, err := d.DB.ExecContext(ctx, `
+		UPDATE jobs SET error_count = $1, last_error = $2, run_at = $3, locked_at = NULL, locked_by = NULL
+		WHERE id = $4`, attempt, cause.Error(), runAt, row.ID); err != nil {
+		log.Println("[durable] failed to reschedule job", row.ID, err.Error())
+	}
+}
+
+// backoff is exponential with +/-10% jitter, capped at 5 minutes, keyed off
+// the number of failed attempts so far.
+func backoff(attempt int) time.Duration {
+	base := time.Second * time.Duration(1<<uint(attempt))
+	if base > 5*time.Minute {
+		base = 5 * time.Minute
+	}
+	jitter := time.Duration(rand.Int63n(int64(base) / 5))
+	d := base - time.Duration(int64(base)/10) + jitter
+	if d > 5*time.Minute {
+		d = 5 * time.Minute
+	}
+	return d
+}
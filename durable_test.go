@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	prev := backoff(1)
+	for attempt := 2; attempt < 8; attempt++ {
+		d := backoff(attempt)
+		if d <= 0 {
+			t.Fatalf("expected positive backoff, got %s", d)
+		}
+		if d <= prev {
+			t.Fatalf("expected backoff to grow with attempt, got %s after %s", d, prev)
+		}
+		prev = d
+	}
+}
+
+func TestBackoffCap(t *testing.T) {
+	d := backoff(30)
+	if d > 5*time.Minute {
+		t.Fatalf("expected backoff to be capped at 5m, got %s", d)
+	}
+}
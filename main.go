@@ -3,16 +3,19 @@ package main
 import (
 	"context"
 	"errors"
-	"fmt"
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/atomic"
+	"golang.org/x/sync/errgroup"
 
 	sctx "github.com/SentimensRG/ctx"
 	"github.com/SentimensRG/ctx/sigctx"
@@ -22,37 +25,206 @@ import (
 )
 
 func main() {
-	db := mustConnectDB()
-	mustSetupDB(db)
-	defer db.Close()
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for in-flight requests and a final flush to complete on shutdown")
+	addr := flag.String("addr", ":8080", "address for the HTTP server to listen on")
+	adminAddr := flag.String("admin-addr", ":9090", "address for the metrics/pprof/health admin server to listen on")
+	storageFlag := flag.String("storage", "postgres", "comma-separated storage backends to fan every accepted payload out to (postgres,kafka)")
+	flag.Parse()
+
+	durable := os.Getenv("DURABLE_JOB") == "true"
+	ctx := sctx.AsContext(sigctx.New())
+
+	if durable {
+		// DurableJob reads and writes through sqlx/lib_pq directly (leasing,
+		// backoff, dead-lettering), so it needs its own full-sized pool; the
+		// pgx pool below isn't used in this mode.
+		db := mustConnectDB()
+		defer db.Close()
+		mustSetupDB(db)
+
+		if err := runDurable(ctx, db, *addr, *adminAddr, *shutdownTimeout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	pool := mustConnectPgxPool(ctx)
+	defer pool.Close()
+	mustSetupRecordsTable(ctx, pool)
+
+	storage, closeStorage := mustBuildStorage(strings.Split(*storageFlag, ","), pool)
+	defer closeStorage()
 
 	job := NewJob()
-	job.Storage = &PostgresStore{DB: db}
+	job.Storage = storage
+	job.ShutdownTimeout = *shutdownTimeout
+	if err := runWithJob(ctx, pgxPinger{pool}, *addr, *adminAddr, job); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	ctx := sctx.AsContext(sigctx.New())
-	go job.Run(ctx)
+// dbPinger is the minimal health-check contract serve/pingDB/newAdminServer
+// need; it lets the same plumbing back a DB health check with either the
+// sqlx pool (durable mode) or the pgx pool (non-durable mode) without
+// opening both in every mode.
+type dbPinger interface {
+	Ping(ctx context.Context) error
+}
+
+// sqlxPinger adapts a *sqlx.DB to dbPinger. db may be non-nil but wrap a nil
+// *sql.DB (as tests do), in which case Ping is a no-op.
+type sqlxPinger struct{ db *sqlx.DB }
+
+func (p sqlxPinger) Ping(ctx context.Context) error {
+	if p.db == nil || p.db.DB == nil {
+		return nil
+	}
+	return p.db.PingContext(ctx)
+}
+
+// runDurable wires the HTTP server, the durable job's worker pool, and a DB
+// health pinger together with an errgroup so that a signal on ctx drains
+// in-flight requests, disables new leases, and returns the first error any
+// of them hit.
+func runDurable(ctx context.Context, db *sqlx.DB, addr, adminAddr string, shutdownTimeout time.Duration) error {
+	g, gctx := errgroup.WithContext(ctx)
+	mustSetupDurableDB(db)
+	durableJob := NewDurableJob(db)
+	g.Go(func() error {
+		durableJob.Run(gctx)
+		return nil
+	})
+	return serve(g, gctx, sqlxPinger{db}, addr, adminAddr, shutdownTimeout, durableJob.Done(), nil, func(r requestPayload) error {
+		return durableJob.Enqueue(gctx, &r)
+	}, nil)
+}
+
+// runWithJob wires the HTTP server and health pinger around an
+// already-configured Job; it exists separately from runDurable so tests can
+// inject an in-memory Storage instead of a live Postgres connection.
+func runWithJob(ctx context.Context, pinger dbPinger, addr, adminAddr string, job *Job) error {
+	g, gctx := errgroup.WithContext(ctx)
+
+	// jobShutdown is only cancelled once serve's shutdown goroutine has
+	// finished draining in-flight /ping requests, so a request accepted
+	// just before shutdown can still reach Push before the job disables
+	// itself and stops accepting pushes.
+	jobShutdown, triggerJobShutdown := context.WithCancel(context.Background())
+	g.Go(func() error {
+		job.Run(jobShutdown)
+		return nil
+	})
+	return serve(g, gctx, pinger, addr, adminAddr, job.ShutdownTimeout, job.Done(), job.Stats, job.Push, triggerJobShutdown)
+}
 
+func serve(g *errgroup.Group, gctx context.Context, pinger dbPinger, addr, adminAddr string, shutdownTimeout time.Duration, jobDone <-chan struct{}, statsFn func() JobStats, push func(requestPayload) error, onDrained func()) error {
 	r := gin.New()
 	r.Use(gin.Recovery())
+	r.Use(metricsMiddleware())
 	r.POST("/ping", func(c *gin.Context) {
-		var r requestPayload
-		if err := c.BindJSON(&r); err != nil {
+		var payload requestPayload
+		if err := c.BindJSON(&payload); err != nil {
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
 
-		if db == nil {
+		if pinger == nil {
 			c.AbortWithError(http.StatusInternalServerError, errors.New("failed to created db"))
 			return
 		}
 
-		job.Push(r)
+		if err := push(payload); err != nil {
+			if errors.Is(err, ErrQueueFull) {
+				c.Header("Retry-After", "1")
+				c.AbortWithStatus(http.StatusTooManyRequests)
+				return
+			}
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
 
 		c.JSON(200, gin.H{"message": "pong"})
 	})
-	go r.Run()
-	<-ctx.Done()
-	<-job.Done()
+
+	srv := &http.Server{Addr: addr, Handler: r}
+	admin := newAdminServer(adminAddr, pinger, statsFn)
+
+	g.Go(func() error {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	})
+
+	g.Go(func() error {
+		if err := admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	})
+
+	g.Go(func() error {
+		<-gctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		err := srv.Shutdown(shutdownCtx)
+		// Only disable/flush the job once in-flight /ping requests have
+		// drained, so one that was accepted just before shutdown still gets
+		// to Push instead of hitting a disabled job and dropping its payload.
+		if onDrained != nil {
+			onDrained()
+		}
+		if err != nil {
+			return err
+		}
+		return admin.Shutdown(shutdownCtx)
+	})
+
+	g.Go(func() error {
+		return pingDB(gctx, pinger)
+	})
+
+	err := g.Wait()
+	<-jobDone
+	return err
+}
+
+// maxConsecutivePingFailures bounds how many back-to-back failed pings
+// pingDB tolerates before treating the connection as dead.
+const maxConsecutivePingFailures = 3
+
+// pingDB periodically checks DB connectivity until ctx is cancelled, so a
+// dead connection shows up as a non-nil error from the errgroup instead of
+// silently failing every save. A single failed ping is logged and retried,
+// since it's often just a transient blip; maxConsecutivePingFailures in a
+// row is treated as the connection being down. pinger may be nil, in which
+// case there's nothing to check.
+func pingDB(ctx context.Context, pinger dbPinger) error {
+	if pinger == nil {
+		return nil
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var failures int
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := pinger.Ping(ctx); err != nil {
+				failures++
+				log.Println("[health] database ping failed:", err.Error())
+				if failures >= maxConsecutivePingFailures {
+					return err
+				}
+				continue
+			}
+			failures = 0
+		}
+	}
 }
 
 type requestPayload struct {
@@ -84,6 +256,23 @@ type Job struct {
 	qMask  uint32
 	queues []*Queue
 
+	// ShutdownTimeout bounds the final flush triggered when ctx is
+	// cancelled, so a stuck DB can't keep the process from exiting.
+	ShutdownTimeout time.Duration
+
+	// ShardCapacity caps how many items a single shard may buffer before
+	// Push starts returning ErrQueueFull; 0 means unbounded.
+	ShardCapacity int
+	// HighWaterMark triggers an immediate flush once a shard's depth
+	// reaches it, ahead of the 5s ticker; 0 disables the trigger.
+	HighWaterMark int
+	// AggregateThreshold triggers an immediate flush once the total depth
+	// across all shards reaches it; 0 disables the trigger.
+	AggregateThreshold int
+
+	flushRequested chan struct{}
+	lastFlush      *atomic.Int64 // unix nano of the last completed flush
+
 	Storage interface {
 		Save(ctx context.Context, items []*requestPayload) error
 	}
@@ -92,10 +281,16 @@ type Job struct {
 func NewJob() *Job {
 	numQueues := 16
 	job := &Job{
-		enabled: atomic.NewBool(true),
-		qIndex:  atomic.NewUint32(0),
-		qMask:   uint32(numQueues - 1),
-		queues:  NewQueues(numQueues),
+		enabled:            atomic.NewBool(true),
+		qIndex:             atomic.NewUint32(0),
+		qMask:              uint32(numQueues - 1),
+		queues:             NewQueues(numQueues),
+		ShutdownTimeout:    10 * time.Second,
+		ShardCapacity:      10000,
+		HighWaterMark:      8000,
+		AggregateThreshold: 100000,
+		flushRequested:     make(chan struct{}, 1),
+		lastFlush:          atomic.NewInt64(time.Now().UnixNano()),
 	}
 
 	job.Context, job.finish = context.WithCancel(context.Background())
@@ -104,13 +299,72 @@ func NewJob() *Job {
 
 var errJobDisabled = errors.New("job disabled")
 
+// ErrQueueFull is returned by Push when a shard is already at
+// ShardCapacity; the HTTP handler maps it to 429 with a Retry-After header.
+var ErrQueueFull = errors.New("queue full")
+
 func (j *Job) Push(r requestPayload) error {
-	if j.enabled.Load() {
-		idx := j.qIndex.Inc() & j.qMask
-		return j.queues[idx].Push(&r)
+	if !j.enabled.Load() {
+		pushTotal.WithLabelValues("disabled").Inc()
+		return errJobDisabled
+	}
+
+	idx := j.qIndex.Inc() & j.qMask
+	q := j.queues[idx]
+
+	if j.ShardCapacity > 0 && q.Depth() >= int64(j.ShardCapacity) {
+		pushTotal.WithLabelValues("full").Inc()
+		return ErrQueueFull
+	}
+
+	err := q.Push(&r)
+	pushTotal.WithLabelValues("ok").Inc()
+
+	if (j.HighWaterMark > 0 && q.Depth() >= int64(j.HighWaterMark)) ||
+		(j.AggregateThreshold > 0 && j.aggregateDepth() >= int64(j.AggregateThreshold)) {
+		j.requestFlush()
+	}
+
+	return err
+}
+
+// aggregateDepth sums every shard's atomic depth counter; cheap enough to
+// call on the push path since it never touches a shard's RWMutex.
+func (j *Job) aggregateDepth() int64 {
+	var total int64
+	for _, q := range j.queues {
+		total += q.Depth()
+	}
+	return total
+}
+
+// requestFlush asks Run to flush ahead of the 5s ticker. It's a
+// non-blocking send so a burst of triggers collapses into a single pending
+// flush instead of piling up.
+func (j *Job) requestFlush() {
+	select {
+	case j.flushRequested <- struct{}{}:
+	default:
 	}
+}
 
-	return errJobDisabled
+// JobStats is a point-in-time snapshot of queue depths and flush timing,
+// exposed so callers (tests, the admin /stats endpoint) can observe
+// backpressure without reaching into Job's internals.
+type JobStats struct {
+	ShardDepths []int64
+	LastFlush   time.Time
+}
+
+func (j *Job) Stats() JobStats {
+	depths := make([]int64, len(j.queues))
+	for i, q := range j.queues {
+		depths[i] = q.Depth()
+	}
+	return JobStats{
+		ShardDepths: depths,
+		LastFlush:   time.Unix(0, j.lastFlush.Load()),
+	}
 }
 
 func (j *Job) Run(ctx context.Context) {
@@ -119,14 +373,24 @@ func (j *Job) Run(ctx context.Context) {
 	defer j.finish()
 
 	ticker := time.NewTicker(5 * time.Second)
+	depthTicker := time.NewTicker(time.Second)
+	defer depthTicker.Stop()
 	for {
 		select {
+		case <-depthTicker.C:
+			j.sampleDepths()
+			continue
+		case <-j.flushRequested:
+			j.flush(j.Context)
+			continue
 		case <-ticker.C:
-			j.flush()
+			j.flush(j.Context)
 			continue
 		case <-ctx.Done():
 			j.enabled.Store(false)
-			j.flush()
+			flushCtx, cancel := context.WithTimeout(context.Background(), j.ShutdownTimeout)
+			j.flush(flushCtx)
+			cancel()
 		}
 		break
 	}
@@ -134,7 +398,19 @@ func (j *Job) Run(ctx context.Context) {
 	log.Println("Exiting run")
 }
 
-func (j *Job) flush() {
+// sampleDepths reads each shard's atomic depth counter into queue_depth;
+// it never takes the shard's RWMutex, so scraping never contends with Push.
+func (j *Job) sampleDepths() {
+	for i, q := range j.queues {
+		queueDepth.WithLabelValues(strconv.Itoa(i)).Set(float64(q.Depth()))
+	}
+}
+
+func (j *Job) flush(ctx context.Context) {
+	timer := prometheus.NewTimer(flushDuration)
+	defer timer.ObserveDuration()
+	defer j.lastFlush.Store(time.Now().UnixNano())
+
 	var batchInsertSize int
 	for k, q := range j.queues {
 		rows := q.Clear()
@@ -145,8 +421,10 @@ func (j *Job) flush() {
 			}
 
 			log.Println("[flush] queue", k, "remaining", len(rows))
-			if err := j.Storage.Save(j.Context, rows[:batchInsertSize]); err != nil {
+			flushBatchSize.Observe(float64(batchInsertSize))
+			if err := j.Storage.Save(ctx, rows[:batchInsertSize]); err != nil {
 				log.Println("Error flushing data", err.Error())
+				storageSaveErrorsTotal.Inc()
 			}
 			rows = rows[batchInsertSize:]
 		}
@@ -156,10 +434,14 @@ func (j *Job) flush() {
 type Queue struct {
 	sync.RWMutex
 	items []*requestPayload
+
+	// depth mirrors len(items) so metrics sampling never has to take
+	// RWMutex on the hot path.
+	depth *atomic.Int64
 }
 
 func NewQueue() *Queue {
-	return &Queue{items: make([]*requestPayload, 0)}
+	return &Queue{items: make([]*requestPayload, 0), depth: atomic.NewInt64(0)}
 }
 
 func NewQueues(size int) []*Queue {
@@ -174,6 +456,7 @@ func (q *Queue) Push(r *requestPayload) error {
 	q.Lock()
 	defer q.Unlock()
 	q.items = append(q.items, r)
+	q.depth.Inc()
 	return nil
 }
 
@@ -183,6 +466,7 @@ func (q *Queue) Clear() []*requestPayload {
 	defer q.Unlock()
 	qs := q.items[:length]
 	q.items = q.items[length:]
+	q.depth.Store(int64(len(q.items)))
 	return qs
 }
 
@@ -192,23 +476,9 @@ func (q *Queue) Len() int {
 	return len(q.items)
 }
 
-type PostgresStore struct {
-	DB *sqlx.DB
+// Depth returns the shard's current size via an atomic load, so metrics
+// sampling doesn't contend with Push/Clear for the RWMutex.
+func (q *Queue) Depth() int64 {
+	return q.depth.Load()
 }
 
-func (s *PostgresStore) Save(ctx context.Context, rows []*requestPayload) error {
-	if len(rows) == 0 {
-		return nil
-	}
-
-	valueStrings := make([]string, 0, len(rows))
-	valueArgs := make([]interface{}, 0, len(rows))
-	for idx, r := range rows {
-		valueStrings = append(valueStrings, fmt.Sprintf("($%d)", idx+1))
-		valueArgs = append(valueArgs, r.Name)
-	}
-
-	query := fmt.Sprintf("INSERT INTO records (name) VALUES %s", strings.Join(valueStrings, ","))
-	_, err := s.DB.ExecContext(ctx, query, valueArgs...)
-	return err
-}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
 	"strconv"
 	"testing"
+	"time"
 
+	"github.com/jmoiron/sqlx"
 	"go.uber.org/atomic"
 )
 
@@ -31,13 +38,149 @@ func TestJob(t *testing.T) {
 	for i := 0; i < numItems; i++ {
 		job.Push(requestPayload{Name: strconv.Itoa(i)})
 	}
-	job.flush()
+	job.flush(context.Background())
 
 	if storage.count() != numItems {
 		t.Fatalf("expected only %d item to be saved, got %d", numItems, storage.count())
 	}
 }
 
+// TestQueueFull pushes enough items to fill every shard to ShardCapacity
+// and asserts the next push is rejected with ErrQueueFull instead of
+// growing the shard further.
+func TestQueueFull(t *testing.T) {
+	job := NewJob()
+	job.ShardCapacity = 5
+	job.HighWaterMark = 0
+	job.AggregateThreshold = 0
+	job.Storage = newInMemoryStorage()
+
+	numShards := len(job.queues)
+	for i := 0; i < numShards*job.ShardCapacity; i++ {
+		if err := job.Push(requestPayload{Name: strconv.Itoa(i)}); err != nil {
+			t.Fatalf("push %d: expected every shard to have room, got %s", i, err.Error())
+		}
+	}
+
+	if err := job.Push(requestPayload{Name: "overflow"}); err != ErrQueueFull {
+		t.Fatalf("expected ErrQueueFull once every shard is at capacity, got %v", err)
+	}
+}
+
+// TestAdaptiveFlush simulates a traffic spike that pushes faster than the
+// 5s ticker would drain it, and asserts AggregateThreshold triggers an
+// immediate flush instead of letting items pile up unbounded.
+func TestAdaptiveFlush(t *testing.T) {
+	job := NewJob()
+	job.ShardCapacity = 0
+	job.HighWaterMark = 0
+	job.AggregateThreshold = 5
+	storage := newInMemoryStorage()
+	job.Storage = storage
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		job.Run(ctx)
+		close(done)
+	}()
+
+	for i := 0; i < 6; i++ {
+		if err := job.Push(requestPayload{Name: strconv.Itoa(i)}); err != nil {
+			t.Fatalf("unexpected push error: %s", err.Error())
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for storage.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if storage.count() == 0 {
+		t.Fatal("expected crossing AggregateThreshold to trigger an immediate flush")
+	}
+
+	cancel()
+	<-done
+}
+
+// TestGracefulShutdown starts the server on an ephemeral port, pushes N
+// items over HTTP, then cancels the run context the same way a SIGTERM
+// would via the signal-derived context in main, and asserts every accepted
+// item still reached Storage.Save before run returns.
+func TestGracefulShutdown(t *testing.T) {
+	storage := newInMemoryStorage()
+
+	numItems := 500
+	ctx, cancel := context.WithCancel(context.Background())
+
+	addr := reserveAddr(t)
+	adminAddr := reserveAddr(t)
+
+	// pinger is only used for the handler's readiness check and the health
+	// pinger in this path; a DB-less sqlx.DB is enough to exercise it.
+	pinger := sqlxPinger{db: sqlx.NewDb(nil, "postgres")}
+
+	errCh := make(chan error, 1)
+	go func() {
+		job := NewJob()
+		job.Storage = storage
+		job.ShutdownTimeout = 5 * time.Second
+		errCh <- runWithJob(ctx, pinger, addr, adminAddr, job)
+	}()
+
+	waitForServer(t, addr)
+	url := fmt.Sprintf("http://%s/ping", addr)
+
+	for i := 0; i < numItems; i++ {
+		body, _ := json.Marshal(requestPayload{Name: strconv.Itoa(i)})
+		resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("push %d failed: %s", i, err.Error())
+		}
+		resp.Body.Close()
+	}
+
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("run returned an error: %s", err.Error())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("run did not shut down in time")
+	}
+
+	if storage.count() != numItems {
+		t.Fatalf("expected %d items to be saved, got %d", numItems, storage.count())
+	}
+}
+
+func reserveAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve an ephemeral port: %s", err.Error())
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func waitForServer(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server never came up")
+}
+
 type inMemoryStorage struct {
 	numItems *atomic.Uint64
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "queue_depth",
+		Help: "Number of items currently buffered in a shard, sampled periodically.",
+	}, []string{"shard"})
+
+	pushTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "push_total",
+		Help: "Push attempts, partitioned by result: ok, disabled (job no longer enabled), or full (shard at capacity).",
+	}, []string{"result"})
+
+	flushDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "flush_duration_seconds",
+		Help: "Time spent flushing all shards to storage.",
+	})
+
+	flushBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "flush_batch_size",
+		Help:    "Number of rows in a single Storage.Save call.",
+		Buckets: []float64{1, 10, 50, 100, 250, 500, 1000},
+	})
+
+	storageSaveErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "storage_save_errors_total",
+		Help: "Errors returned by Storage.Save.",
+	})
+
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests handled, partitioned by route and status code.",
+	}, []string{"path", "code"})
+)
+
+// metricsMiddleware records http_requests_total without adding any locking
+// of its own; gin.Context.Writer already tracks the status code.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		httpRequestsTotal.WithLabelValues(c.FullPath(), strconv.Itoa(c.Writer.Status())).Inc()
+	}
+}
+
+// newAdminServer mounts Prometheus metrics, pprof, health/readiness probes,
+// and (when statsFn is non-nil) a /stats endpoint on their own server so
+// scraping and profiling never compete with the /ping listener. pinger may
+// be nil, in which case /readyz always succeeds.
+func newAdminServer(addr string, pinger dbPinger, statsFn func() JobStats) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if pinger != nil {
+			ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+			defer cancel()
+			if err := pinger.Ping(ctx); err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	if statsFn != nil {
+		mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(statsFn())
+		})
+	}
+
+	return &http.Server{Addr: addr, Handler: mux}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Storage is implemented by every backend Job can flush accepted payloads
+// to: PostgresStore, KafkaStore, and MultiStore (which fans out to several
+// of them at once).
+type Storage interface {
+	Save(ctx context.Context, items []*requestPayload) error
+}
+
+// mustBuildStorage turns --storage=postgres,kafka into the Storage Job
+// flushes to. When more than one backend is configured, the first one
+// listed is the MultiStore primary: its failures fail Save even when the
+// others succeeded.
+func mustBuildStorage(names []string, pool *pgxpool.Pool) (Storage, func() error) {
+	if len(names) == 1 {
+		return mustBuildBackend(names[0], pool)
+	}
+
+	backends := make([]MultiStoreBackend, len(names))
+	closers := make([]func() error, len(names))
+	for i, name := range names {
+		s, closeFn := mustBuildBackend(name, pool)
+		backends[i] = MultiStoreBackend{Name: strings.TrimSpace(name), Storage: s, Primary: i == 0}
+		closers[i] = closeFn
+	}
+
+	return &MultiStore{Backends: backends}, func() error {
+		var firstErr error
+		for _, c := range closers {
+			if err := c(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+}
+
+func mustBuildBackend(name string, pool *pgxpool.Pool) (Storage, func() error) {
+	switch strings.TrimSpace(name) {
+	case "postgres":
+		return &PostgresStore{Pool: pool}, func() error { return nil }
+	case "kafka":
+		store := mustConnectKafkaStore()
+		return store, store.Close
+	default:
+		log.Fatalf("unknown storage backend %q", name)
+		return nil, nil
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaKeyStrategy selects how KafkaStore assigns a message key, which in
+// turn decides how the broker partitions it.
+type KafkaKeyStrategy int
+
+const (
+	KafkaKeyRoundRobin KafkaKeyStrategy = iota
+	KafkaKeyHashName
+)
+
+// KafkaStore produces one message per requestPayload to a configured topic,
+// for callers that want ingested payloads fanned out to a stream alongside
+// (or instead of) Postgres.
+type KafkaStore struct {
+	Writer      *kafka.Writer
+	KeyStrategy KafkaKeyStrategy
+}
+
+// mustConnectKafkaStore builds a KafkaStore from KAFKA_BROKERS (comma
+// separated), KAFKA_TOPIC, and KAFKA_KEY_STRATEGY ("round-robin", the
+// default, or "hash-name").
+func mustConnectKafkaStore() *KafkaStore {
+	brokers := strings.Split(os.Getenv("KAFKA_BROKERS"), ",")
+	topic := os.Getenv("KAFKA_TOPIC")
+	if topic == "" {
+		log.Fatal("KAFKA_TOPIC must be set when kafka is a configured storage backend")
+	}
+
+	keyStrategy := KafkaKeyRoundRobin
+	var balancer kafka.Balancer = &kafka.RoundRobin{}
+	if os.Getenv("KAFKA_KEY_STRATEGY") == "hash-name" {
+		keyStrategy = KafkaKeyHashName
+		balancer = &kafka.Hash{}
+	}
+
+	return &KafkaStore{
+		Writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     balancer,
+			RequiredAcks: kafka.RequireAll,
+			BatchTimeout: 10 * time.Millisecond,
+		},
+		KeyStrategy: keyStrategy,
+	}
+}
+
+func (s *KafkaStore) Save(ctx context.Context, rows []*requestPayload) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	msgs := make([]kafka.Message, len(rows))
+	for i, r := range rows {
+		payload, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		msgs[i] = kafka.Message{Key: s.key(r), Value: payload}
+	}
+
+	return s.Writer.WriteMessages(ctx, msgs...)
+}
+
+// key returns the message key used for partitioning. Round-robin leaves it
+// nil so kafka.Writer's RoundRobin balancer rotates partitions itself;
+// hash-name keys on the payload name so kafka.Hash routes same-name payloads
+// to the same partition.
+func (s *KafkaStore) key(r *requestPayload) []byte {
+	if s.KeyStrategy == KafkaKeyHashName {
+		h := fnv.New32a()
+		h.Write([]byte(r.Name))
+		return []byte(strconv.FormatUint(uint64(h.Sum32()), 10))
+	}
+	return nil
+}
+
+func (s *KafkaStore) Close() error {
+	return s.Writer.Close()
+}
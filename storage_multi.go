@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// MultiStoreBackend pairs a Storage with the name used in errors and
+// whether its failures fail the whole Save (Primary) or are isolated and
+// merely reported alongside any others.
+type MultiStoreBackend struct {
+	Name    string
+	Storage Storage
+	Primary bool
+}
+
+// MultiStore fans Save out to every configured backend. A non-primary
+// backend failing doesn't stop the others from being attempted and doesn't
+// fail the call; a primary backend failing fails the call, though the
+// remaining backends are still attempted.
+type MultiStore struct {
+	Backends []MultiStoreBackend
+}
+
+func (m *MultiStore) Save(ctx context.Context, rows []*requestPayload) error {
+	var primaryErr error
+
+	for _, b := range m.Backends {
+		if err := b.Storage.Save(ctx, rows); err != nil {
+			if b.Primary {
+				primaryErr = fmt.Errorf("%s (primary): %w", b.Name, err)
+				continue
+			}
+			log.Println("[multi-store] isolated error from non-primary backend", b.Name+":", err.Error())
+			storageSaveErrorsTotal.Inc()
+		}
+	}
+
+	return primaryErr
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type stubStore struct {
+	err error
+}
+
+func (s *stubStore) Save(ctx context.Context, rows []*requestPayload) error {
+	return s.err
+}
+
+func TestMultiStoreIsolatesNonPrimaryFailures(t *testing.T) {
+	store := &MultiStore{Backends: []MultiStoreBackend{
+		{Name: "postgres", Storage: &stubStore{}, Primary: true},
+		{Name: "kafka", Storage: &stubStore{err: errors.New("broker unreachable")}, Primary: false},
+	}}
+
+	if err := store.Save(context.Background(), []*requestPayload{{Name: "1"}}); err != nil {
+		t.Fatalf("expected a non-primary failure to be isolated, got %s", err.Error())
+	}
+}
+
+func TestMultiStoreFailsOnPrimaryError(t *testing.T) {
+	store := &MultiStore{Backends: []MultiStoreBackend{
+		{Name: "postgres", Storage: &stubStore{err: errors.New("connection refused")}, Primary: true},
+		{Name: "kafka", Storage: &stubStore{}, Primary: false},
+	}}
+
+	if err := store.Save(context.Background(), []*requestPayload{{Name: "1"}}); err == nil {
+		t.Fatal("expected a primary backend failure to fail Save")
+	}
+}
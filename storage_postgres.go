@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PostgresStore persists rows with a binary COPY, which isn't capped by
+// Postgres's 65535-parameter limit the way the multi-values INSERT it
+// replaces was, and is markedly faster at the 1000-row batches flush emits.
+// It only needs Save(ctx, []*requestPayload) error to satisfy Job.Storage,
+// so swapping it in doesn't touch inMemoryStorage or any other backend.
+type PostgresStore struct {
+	Pool *pgxpool.Pool
+}
+
+// mustConnectPgxPool opens the pool used by PostgresStore. Pool sizing is
+// controlled by PGXPOOL_MAX_CONNS so operators can tune it per environment
+// without a redeploy.
+func mustConnectPgxPool(ctx context.Context) *pgxpool.Pool {
+	cfg, err := pgxpool.ParseConfig(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if n := os.Getenv("PGXPOOL_MAX_CONNS"); n != "" {
+		max, err := strconv.Atoi(n)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.MaxConns = int32(max)
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return pool
+}
+
+// mustSetupRecordsTable creates the records table PostgresStore writes to.
+// It's the pgx-pool counterpart to mustSetupDB, used in non-durable mode so
+// that mode doesn't need a separate sqlx pool just to run one DDL statement.
+func mustSetupRecordsTable(ctx context.Context, pool *pgxpool.Pool) {
+	_, err := pool.Exec(ctx, `
+	CREATE TABLE IF NOT EXISTS records (
+		id serial primary key,
+		name text
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// pgxPinger adapts a *pgxpool.Pool to dbPinger.
+type pgxPinger struct{ pool *pgxpool.Pool }
+
+func (p pgxPinger) Ping(ctx context.Context) error {
+	return p.pool.Ping(ctx)
+}
+
+func (s *PostgresStore) Save(ctx context.Context, rows []*requestPayload) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	src := pgx.CopyFromSlice(len(rows), func(i int) ([]interface{}, error) {
+		return []interface{}{rows[i].Name}, nil
+	})
+
+	_, err := s.Pool.CopyFrom(ctx, pgx.Identifier{"records"}, []string{"name"}, src)
+	return err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jmoiron/sqlx"
+)
+
+// postgresMaxParams is Postgres's hard limit on parameters in a single
+// query, which bounds how many rows legacyInsertStore can fit in one
+// multi-values INSERT since it binds one parameter per row.
+const postgresMaxParams = 65535
+
+// legacyInsertStore is the multi-values INSERT PostgresStore used to build
+// before the COPY migration, kept here only so BenchmarkSave has a baseline
+// to compare against.
+type legacyInsertStore struct {
+	DB *sqlx.DB
+}
+
+func (s *legacyInsertStore) Save(ctx context.Context, rows []*requestPayload) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	valueStrings := make([]string, 0, len(rows))
+	valueArgs := make([]interface{}, 0, len(rows))
+	for idx, r := range rows {
+		valueStrings = append(valueStrings, fmt.Sprintf("($%d)", idx+1))
+		valueArgs = append(valueArgs, r.Name)
+	}
+
+	query := fmt.Sprintf("INSERT INTO records (name) VALUES %s", strings.Join(valueStrings, ","))
+	_, err := s.DB.ExecContext(ctx, query, valueArgs...)
+	return err
+}
+
+// BenchmarkSave compares the legacy multi-values INSERT against the
+// COPY-based PostgresStore at 1k, 10k and 100k rows per Save (flush itself
+// emits batches of at most 1000 rows). It needs
+// DATABASE_URL to point at a scratch database and is skipped otherwise,
+// since unit test runs don't provision Postgres.
+func BenchmarkSave(b *testing.B) {
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		b.Skip("DATABASE_URL not set")
+	}
+
+	ctx := context.Background()
+
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer pool.Close()
+
+	db := sqlx.MustOpen("postgres", dsn)
+	defer db.Close()
+	mustSetupDB(db)
+
+	copyStore := &PostgresStore{Pool: pool}
+	insertStore := &legacyInsertStore{DB: db}
+
+	for _, n := range []int{1000, 10000, 100000} {
+		rows := benchRows(n)
+
+		b.Run(fmt.Sprintf("copy/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := copyStore.Save(ctx, rows); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("multi-values-insert/%d", n), func(b *testing.B) {
+			if n > postgresMaxParams {
+				b.Skipf("multi-values INSERT binds one parameter per row; %d exceeds Postgres's %d-parameter limit", n, postgresMaxParams)
+			}
+			for i := 0; i < b.N; i++ {
+				if err := insertStore.Save(ctx, rows); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func benchRows(n int) []*requestPayload {
+	rows := make([]*requestPayload, n)
+	for i := range rows {
+		rows[i] = &requestPayload{Name: strconv.Itoa(i)}
+	}
+	return rows
+}